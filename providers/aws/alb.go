@@ -0,0 +1,450 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"k8s.io/api/core/v1"
+)
+
+// albDNSAnnotation is set on a pod once its ALB listener rule is live, so
+// that downstream controllers can discover where to reach it.
+const albDNSAnnotation = "virtual-kubelet.io/alb-dns"
+
+// ingressForPod provisions (or reuses) an ALB target group for pod, points
+// a listener rule at it, registers the task's ENI as the sole target, and
+// locks the task's security group down to ingress from the ALB's security
+// groups only. It is a no-op for pods that don't expose any containerPorts.
+// Every resource it creates is recorded on tracker so CreatePod can roll it
+// back if a later step fails.
+func (p *Provider) ingressForPod(pod *v1.Pod, privateIP string, tracker *resourceTracker) error {
+	ports := containerPorts(pod)
+	if len(ports) == 0 {
+		return nil
+	}
+	if p.config.LoadBalancerArn == "" || p.config.ListenerArn == "" {
+		return fmt.Errorf("pod %s/%s exposes containerPorts but no LoadBalancerArn/ListenerArn is configured", pod.Namespace, pod.Name)
+	}
+
+	// Only the first declared port is fronted: ALB target groups are
+	// one-port-per-group and each pod gets a single target group, so any
+	// further containerPorts are not reachable through the load balancer.
+	port := ports[0]
+
+	targetGroupArn, err := p.ensureTargetGroup(pod, port, tracker)
+	if err != nil {
+		return fmt.Errorf("unable to create target group for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	if _, err := p.elbv2Client.RegisterTargets(&elbv2.RegisterTargetsInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+		Targets: []*elbv2.TargetDescription{
+			{Id: aws.String(privateIP), Port: aws.Int64(port)},
+		},
+	}); err != nil {
+		return fmt.Errorf("unable to register target for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	if _, err := p.createListenerRule(pod, targetGroupArn, tracker); err != nil {
+		return fmt.Errorf("unable to create listener rule for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	if err := p.restrictIngressToALB(port, tracker); err != nil {
+		return fmt.Errorf("unable to restrict security group ingress for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	lb, err := p.elbv2Client.DescribeLoadBalancers(&elbv2.DescribeLoadBalancersInput{
+		LoadBalancerArns: []*string{aws.String(p.config.LoadBalancerArn)},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to describe load balancer for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[albDNSAnnotation] = fmt.Sprintf("%s%s", *lb.LoadBalancers[0].DNSName, pathPatternForPod(pod))
+
+	return nil
+}
+
+// deleteIngressForPod tears down the listener rule and target group
+// ingressForPod created for pod. The shared security group ingress rule
+// authorized by restrictIngressToALB is left in place, and its reference
+// count is not released.
+func (p *Provider) deleteIngressForPod(pod *v1.Pod) error {
+	if p.config.LoadBalancerArn == "" || p.config.ListenerArn == "" {
+		return nil
+	}
+
+	targetGroupArn, ruleArn, err := p.findIngressResources(pod)
+	if err != nil {
+		return err
+	}
+	if targetGroupArn == "" {
+		return nil
+	}
+
+	if ruleArn != "" {
+		if err := p.deleteRuleIgnoreNotFound(ruleArn); err != nil {
+			return fmt.Errorf("unable to delete listener rule for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+	}
+
+	if err := p.deleteTargetGroupIgnoreNotFound(targetGroupArn); err != nil {
+		return fmt.Errorf("unable to delete target group for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	return nil
+}
+
+func (p *Provider) ensureTargetGroup(pod *v1.Pod, port int64, tracker *resourceTracker) (string, error) {
+	if existingArn, err := p.findTargetGroup(pod); err != nil {
+		return "", err
+	} else if existingArn != "" {
+		// A previous CreatePod attempt for this pod already got this far
+		// before a later step failed (or the caller is simply retrying);
+		// reuse it rather than hitting DuplicateTargetGroupName.
+		tracker.record(fmt.Sprintf("delete target group %s", existingArn), func() error {
+			return p.deleteTargetGroupIgnoreNotFound(existingArn)
+		})
+		return existingArn, nil
+	}
+
+	lb, err := p.elbv2Client.DescribeLoadBalancers(&elbv2.DescribeLoadBalancersInput{
+		LoadBalancerArns: []*string{aws.String(p.config.LoadBalancerArn)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	output, err := p.elbv2Client.CreateTargetGroup(&elbv2.CreateTargetGroupInput{
+		Name:       aws.String(targetGroupName(pod)),
+		Port:       aws.Int64(port),
+		Protocol:   aws.String(elbv2.ProtocolEnumHttp),
+		TargetType: aws.String(elbv2.TargetTypeEnumIp),
+		VpcId:      lb.LoadBalancers[0].VpcId,
+	})
+	if err != nil {
+		return "", err
+	}
+	targetGroupArn := *output.TargetGroups[0].TargetGroupArn
+	tracker.record(fmt.Sprintf("delete target group %s", targetGroupArn), func() error {
+		return p.deleteTargetGroupIgnoreNotFound(targetGroupArn)
+	})
+
+	if _, err := p.elbv2Client.AddTags(&elbv2.AddTagsInput{
+		ResourceArns: []*string{aws.String(targetGroupArn)},
+		Tags: []*elbv2.Tag{
+			{Key: aws.String("PodNamespace"), Value: aws.String(pod.Namespace)},
+			{Key: aws.String("PodName"), Value: aws.String(pod.Name)},
+		},
+	}); err != nil {
+		return "", err
+	}
+
+	return targetGroupArn, nil
+}
+
+// createListenerRule allocates the next free priority on the configured
+// listener and points it at targetGroupArn via a path-based condition
+// scoped to the pod, e.g. "/default/my-pod*".
+func (p *Provider) createListenerRule(pod *v1.Pod, targetGroupArn string, tracker *resourceTracker) (string, error) {
+	priority, err := p.nextRulePriority()
+	if err != nil {
+		return "", err
+	}
+
+	output, err := p.elbv2Client.CreateRule(&elbv2.CreateRuleInput{
+		ListenerArn: aws.String(p.config.ListenerArn),
+		Priority:    aws.Int64(priority),
+		Conditions: []*elbv2.RuleCondition{
+			{
+				Field:  aws.String("path-pattern"),
+				Values: []*string{aws.String(pathPatternForPod(pod))},
+			},
+		},
+		Actions: []*elbv2.Action{
+			{
+				Type:           aws.String(elbv2.ActionTypeEnumForward),
+				TargetGroupArn: aws.String(targetGroupArn),
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	ruleArn := *output.Rules[0].RuleArn
+	tracker.record(fmt.Sprintf("delete listener rule %s", ruleArn), func() error {
+		return p.deleteRuleIgnoreNotFound(ruleArn)
+	})
+
+	if _, err := p.elbv2Client.AddTags(&elbv2.AddTagsInput{
+		ResourceArns: []*string{aws.String(ruleArn)},
+		Tags: []*elbv2.Tag{
+			{Key: aws.String("PodNamespace"), Value: aws.String(pod.Namespace)},
+			{Key: aws.String("PodName"), Value: aws.String(pod.Name)},
+		},
+	}); err != nil {
+		return "", err
+	}
+
+	return ruleArn, nil
+}
+
+func (p *Provider) deleteTargetGroupIgnoreNotFound(targetGroupArn string) error {
+	_, err := p.elbv2Client.DeleteTargetGroup(&elbv2.DeleteTargetGroupInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+	})
+	if isNotFoundErr(err) {
+		return nil
+	}
+	return err
+}
+
+func (p *Provider) deleteRuleIgnoreNotFound(ruleArn string) error {
+	_, err := p.elbv2Client.DeleteRule(&elbv2.DeleteRuleInput{
+		RuleArn: aws.String(ruleArn),
+	})
+	if isNotFoundErr(err) {
+		return nil
+	}
+	return err
+}
+
+// nextRulePriority probes upward from config.RulePriorityStart for the
+// first priority not already in use on the configured listener.
+func (p *Provider) nextRulePriority() (int64, error) {
+	rules, err := p.elbv2Client.DescribeRules(&elbv2.DescribeRulesInput{
+		ListenerArn: aws.String(p.config.ListenerArn),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	used := map[int64]bool{}
+	for _, rule := range rules.Rules {
+		if rule.Priority == nil || *rule.Priority == "default" {
+			continue
+		}
+		var priority int64
+		if _, err := fmt.Sscanf(*rule.Priority, "%d", &priority); err == nil {
+			used[priority] = true
+		}
+	}
+
+	for priority := int64(p.config.RulePriorityStart); ; priority++ {
+		if !used[priority] {
+			return priority, nil
+		}
+	}
+}
+
+// findTargetGroup looks up the target group previously created for pod by
+// ensureTargetGroup, if any, identifying it by the same deterministic name
+// ensureTargetGroup would have used.
+func (p *Provider) findTargetGroup(pod *v1.Pod) (string, error) {
+	tgOutput, err := p.elbv2Client.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+		Names: []*string{aws.String(targetGroupName(pod))},
+	})
+	if err != nil {
+		if isNotFoundErr(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("unable to describe target group for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	if len(tgOutput.TargetGroups) == 0 {
+		return "", nil
+	}
+	return *tgOutput.TargetGroups[0].TargetGroupArn, nil
+}
+
+// findIngressResources looks up the target group previously created for pod
+// (by its deterministic name) and the listener rule forwarding to it, if any.
+func (p *Provider) findIngressResources(pod *v1.Pod) (targetGroupArn, ruleArn string, err error) {
+	targetGroupArn, err = p.findTargetGroup(pod)
+	if err != nil {
+		return "", "", err
+	}
+	if targetGroupArn == "" {
+		return "", "", nil
+	}
+
+	rules, err := p.elbv2Client.DescribeRules(&elbv2.DescribeRulesInput{
+		ListenerArn: aws.String(p.config.ListenerArn),
+	})
+	if err != nil {
+		return targetGroupArn, "", fmt.Errorf("unable to describe listener rules: %v", err)
+	}
+	for _, rule := range rules.Rules {
+		for _, action := range rule.Actions {
+			if action.TargetGroupArn != nil && *action.TargetGroupArn == targetGroupArn {
+				ruleArn = *rule.RuleArn
+			}
+		}
+	}
+
+	return targetGroupArn, ruleArn, nil
+}
+
+// restrictIngressToALB authorizes ingress on port, for every security group
+// the provider attaches to task ENIs, from only the ALB's own security
+// groups - so pods are reachable through the load balancer and nowhere else.
+//
+// The security groups in p.config.SecurityGroups are shared by every pod, so
+// two pods exposing the same port on the same security group authorize the
+// exact same rule. Rather than calling AuthorizeSecurityGroupIngress (and
+// the rollback's RevokeSecurityGroupIngress) once per pod, the rule is
+// reference-counted per (security group, port) on the provider: only the
+// first pod to need a rule actually creates it, and it is only revoked once
+// the last pod that needed it has rolled back.
+func (p *Provider) restrictIngressToALB(port int64, tracker *resourceTracker) error {
+	lb, err := p.elbv2Client.DescribeLoadBalancers(&elbv2.DescribeLoadBalancersInput{
+		LoadBalancerArns: []*string{aws.String(p.config.LoadBalancerArn)},
+	})
+	if err != nil {
+		return err
+	}
+
+	permissions := make([]*ec2.IpPermission, 0, len(lb.LoadBalancers[0].SecurityGroups))
+	for _, sg := range lb.LoadBalancers[0].SecurityGroups {
+		permissions = append(permissions, &ec2.IpPermission{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int64(port),
+			ToPort:     aws.Int64(port),
+			UserIdGroupPairs: []*ec2.UserIdGroupPair{
+				{GroupId: sg},
+			},
+		})
+	}
+
+	for _, securityGroupID := range p.config.SecurityGroups {
+		securityGroupID := securityGroupID
+		refKey := ingressRefKey(securityGroupID, port)
+
+		if p.acquireIngressRef(refKey) {
+			if _, err := p.ec2Client.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+				GroupId:       aws.String(securityGroupID),
+				IpPermissions: permissions,
+			}); err != nil && !isDuplicatePermissionErr(err) {
+				p.releaseIngressRef(refKey)
+				return err
+			}
+		}
+
+		tracker.record(fmt.Sprintf("revoke ingress on security group %s", securityGroupID), func() error {
+			if p.releaseIngressRef(refKey) {
+				return nil
+			}
+			_, err := p.ec2Client.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+				GroupId:       aws.String(securityGroupID),
+				IpPermissions: permissions,
+			})
+			if isNotFoundErr(err) {
+				return nil
+			}
+			return err
+		})
+	}
+
+	return nil
+}
+
+// ingressRefKey identifies the shared ALB ingress rule for a (security
+// group, port) pair in p.ingressRefCounts.
+func ingressRefKey(securityGroupID string, port int64) string {
+	return fmt.Sprintf("%s:%d", securityGroupID, port)
+}
+
+// acquireIngressRef increments the reference count for refKey and reports
+// whether the caller is the first holder (and so must actually create the
+// underlying AWS rule).
+func (p *Provider) acquireIngressRef(refKey string) bool {
+	p.ingressRefCountsMu.Lock()
+	defer p.ingressRefCountsMu.Unlock()
+	first := p.ingressRefCounts[refKey] == 0
+	p.ingressRefCounts[refKey]++
+	return first
+}
+
+// releaseIngressRef decrements the reference count for refKey and reports
+// whether other holders remain (and so the underlying AWS rule must be left
+// in place).
+func (p *Provider) releaseIngressRef(refKey string) bool {
+	p.ingressRefCountsMu.Lock()
+	defer p.ingressRefCountsMu.Unlock()
+	if p.ingressRefCounts[refKey] > 0 {
+		p.ingressRefCounts[refKey]--
+	}
+	return p.ingressRefCounts[refKey] > 0
+}
+
+// rebuildIngressRefCounts seeds p.ingressRefCounts from the pods Kubernetes
+// currently knows about, each of which - if it exposes a containerPort - has
+// a live ALB ingress rule on the provider's shared security groups that
+// ingressForPod authorized for it. This must run once at startup, via
+// Reconcile, before any CreatePod/DeletePod call can touch the counts:
+// they live only in process memory and reset to zero across a restart, even
+// though the AWS rules they track survive it, so without this a freshly
+// restarted provider would think it's the sole owner of a rule other,
+// already-running pods still depend on.
+//
+// A pod only counts once albDNSAnnotation is present: ingressForPod sets it
+// as the last step, after restrictIngressToALB has actually run, so a pod
+// whose CreatePod crashed before reaching it never authorized the rule in
+// the first place and must not be seeded into the count.
+func (p *Provider) rebuildIngressRefCounts(pods []*v1.Pod) {
+	if p.config.LoadBalancerArn == "" || p.config.ListenerArn == "" {
+		return
+	}
+
+	p.ingressRefCountsMu.Lock()
+	defer p.ingressRefCountsMu.Unlock()
+
+	for _, pod := range pods {
+		if pod.Annotations[albDNSAnnotation] == "" {
+			continue
+		}
+		ports := containerPorts(pod)
+		if len(ports) == 0 {
+			continue
+		}
+		port := ports[0]
+		for _, securityGroupID := range p.config.SecurityGroups {
+			p.ingressRefCounts[ingressRefKey(securityGroupID, port)]++
+		}
+	}
+}
+
+func targetGroupName(pod *v1.Pod) string {
+	return "vk-" + invalidFamilyChars.ReplaceAllString(pod.Namespace+"-"+pod.Name, "-")
+}
+
+func pathPatternForPod(pod *v1.Pod) string {
+	return fmt.Sprintf("/%s/%s*", pod.Namespace, pod.Name)
+}
+
+func containerPorts(pod *v1.Pod) []int64 {
+	var ports []int64
+	for _, container := range pod.Spec.Containers {
+		for _, p := range container.Ports {
+			ports = append(ports, int64(p.ContainerPort))
+		}
+	}
+	return ports
+}
+
+func isNotFoundErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "NotFound")
+}
+
+// isDuplicatePermissionErr reports whether err is EC2's response to
+// authorizing a security group rule that already exists - expected when the
+// in-process reference count has been reset (e.g. a provider restart) but
+// the rule a sibling pod still depends on is already live in AWS.
+func isDuplicatePermissionErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "InvalidPermission.Duplicate")
+}
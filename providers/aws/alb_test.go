@@ -0,0 +1,58 @@
+package aws
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func podWithPort(port int32, ingressLive bool) *v1.Pod {
+	pod := &v1.Pod{
+		Spec: v1.PodSpec{Containers: []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: port}}}}},
+	}
+	if ingressLive {
+		pod.ObjectMeta = metav1.ObjectMeta{Annotations: map[string]string{albDNSAnnotation: "alb.example.com/default/foo*"}}
+	}
+	return pod
+}
+
+func TestRebuildIngressRefCountsSeedsFromKnownPods(t *testing.T) {
+	p := &Provider{
+		ingressRefCounts: map[string]int{},
+		config: Config{
+			LoadBalancerArn: "lb-arn",
+			ListenerArn:     "listener-arn",
+			SecurityGroups:  []string{"sg-1", "sg-2"},
+		},
+	}
+
+	pods := []*v1.Pod{
+		podWithPort(8080, true),
+		podWithPort(8080, true),
+		podWithPort(8080, false),                         // CreatePod never got as far as restrictIngressToALB, should be ignored
+		{Spec: v1.PodSpec{Containers: []v1.Container{}}}, // exposes no ports, should be ignored
+	}
+
+	p.rebuildIngressRefCounts(pods)
+
+	for _, sg := range p.config.SecurityGroups {
+		if got := p.ingressRefCounts[ingressRefKey(sg, 8080)]; got != 2 {
+			t.Errorf("expected ref count 2 for %s:8080 after reseeding from 2 live pods, got %d", sg, got)
+		}
+	}
+}
+
+func TestRebuildIngressRefCountsNoopWithoutALBConfigured(t *testing.T) {
+	p := &Provider{ingressRefCounts: map[string]int{}}
+
+	pods := []*v1.Pod{
+		{Spec: v1.PodSpec{Containers: []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: 8080}}}}}},
+	}
+
+	p.rebuildIngressRefCounts(pods)
+
+	if len(p.ingressRefCounts) != 0 {
+		t.Errorf("expected no ref counts without LoadBalancerArn/ListenerArn configured, got %v", p.ingressRefCounts)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -214,6 +215,481 @@ func TestAWS(t *testing.T) {
 		}
 	})
 
+	t.Run("PreStop hook", func(t *testing.T) {
+		if clusterID == nil || logGroupdID == nil || executorRoleID == nil || subnetID == nil {
+			t.Fatal("Can't start tests without all required being created.")
+		}
+		config := fmt.Sprintf(testConfig, testRegion, *clusterID, *logGroupdID, *executorRoleID, *subnetID)
+
+		tmpfile, err := ioutil.TempFile("", "example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmpfile.Name()) // clean up
+
+		if _, err = tmpfile.Write([]byte(config)); err != nil {
+			t.Fatal(err)
+		}
+		if err = tmpfile.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		provider, err := NewProvider(tmpfile.Name(), nil, "vk-aws-test", "Linux", "1.2.3.4", 10250)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		podName := fmt.Sprintf("test_lifecycle_%d", time.Now().UnixNano()/1000)
+
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      podName,
+				Namespace: "default",
+				UID:       types.UID("unique-lifecycle"),
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{v1.Container{
+					Name:  "echo-container",
+					Image: "busybox",
+					Command: []string{
+						"/bin/sh",
+					},
+					Args: []string{
+						// ECS Exec output goes over the SSM data channel, not
+						// this container's stdout, so awslogs never sees it
+						// directly. Instead the PreStop hook leaves a marker
+						// file in the container's own filesystem, and this
+						// process cats it to stdout (where awslogs picks it
+						// up) from a SIGTERM trap that fires exactly when
+						// DeletePod stops the task, after the hook has run.
+						"-c", "trap 'cat /tmp/prestop-marker 2>/dev/null; exit 0' TERM; echo \"Started\"; while true; do sleep 1; done",
+					},
+					Lifecycle: &v1.Lifecycle{
+						PreStop: &v1.Handler{
+							Exec: &v1.ExecAction{
+								Command: []string{"/bin/sh", "-c", "echo \"PreStop ran\" > /tmp/prestop-marker"},
+							},
+						},
+					},
+					Resources: v1.ResourceRequirements{
+						Limits: v1.ResourceList{
+							v1.ResourceCPU:    resource.MustParse("200"),
+							v1.ResourceMemory: resource.MustParse("450Mi"),
+						},
+						Requests: v1.ResourceList{
+							v1.ResourceCPU:    resource.MustParse("100"),
+							v1.ResourceMemory: resource.MustParse("256Mi"),
+						},
+					},
+				}},
+			},
+		}
+
+		err = provider.CreatePod(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = waitUntilPodStatus(provider, podName, v1.PodRunning)
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = provider.DeletePod(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = waitUntilPodStatus(provider, podName, v1.PodSucceeded)
+		if err != nil {
+			t.Error(err)
+		}
+
+		logs, err := provider.GetContainerLogs("default", podName, "echo-container", 100)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if !strings.Contains(logs, "PreStop ran") {
+			t.Errorf("Expected logs to contain the PreStop hook marker, but received %q", logs)
+		}
+	})
+
+	t.Run("Disruption condition on out-of-band stop", func(t *testing.T) {
+		if clusterID == nil || logGroupdID == nil || executorRoleID == nil || subnetID == nil {
+			t.Fatal("Can't start tests without all required being created.")
+		}
+		config := fmt.Sprintf(testConfig, testRegion, *clusterID, *logGroupdID, *executorRoleID, *subnetID)
+
+		tmpfile, err := ioutil.TempFile("", "example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmpfile.Name()) // clean up
+
+		if _, err = tmpfile.Write([]byte(config)); err != nil {
+			t.Fatal(err)
+		}
+		if err = tmpfile.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		provider, err := NewProvider(tmpfile.Name(), nil, "vk-aws-test", "Linux", "1.2.3.4", 10250)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		podName := fmt.Sprintf("test_disruption_%d", time.Now().UnixNano()/1000)
+
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      podName,
+				Namespace: "default",
+				UID:       types.UID("unique-disruption"),
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{v1.Container{
+					Name:  "echo-container",
+					Image: "busybox",
+					Command: []string{
+						"/bin/sh",
+					},
+					Args: []string{
+						"-c", "echo \"Started\"; while true; do sleep 1; done",
+					},
+					Resources: v1.ResourceRequirements{
+						Limits: v1.ResourceList{
+							v1.ResourceCPU:    resource.MustParse("200"),
+							v1.ResourceMemory: resource.MustParse("450Mi"),
+						},
+						Requests: v1.ResourceList{
+							v1.ResourceCPU:    resource.MustParse("100"),
+							v1.ResourceMemory: resource.MustParse("256Mi"),
+						},
+					},
+				}},
+			},
+		}
+
+		err = provider.CreatePod(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = waitUntilPodStatus(provider, podName, v1.PodRunning)
+		if err != nil {
+			t.Error(err)
+		}
+
+		task, err := provider.lookupTask(pod.Namespace, pod.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Simulate an infrastructure-initiated stop rather than a DeletePod
+		// call, the way a capacity-provider scale-in would.
+		_, err = provider.ecsClient.StopTask(&ecs.StopTaskInput{
+			Cluster: aws.String(provider.config.Cluster),
+			Task:    task.TaskArn,
+			Reason:  aws.String("Scaling activity initiated by (capacity provider vk-aws-e2e-test-cp)"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = waitUntilPodStatus(provider, podName, v1.PodSucceeded)
+		if err != nil {
+			t.Error(err)
+		}
+
+		status, err := provider.GetPodStatus(pod.Namespace, pod.Name)
+		if err != nil {
+			t.Error(err)
+		}
+		if status == nil {
+			t.Fatal("Expected a pod status for the stopped task, but the task had already disappeared")
+		}
+
+		var found bool
+		for _, condition := range status.Conditions {
+			if condition.Type == PodConditionDisruptionTarget {
+				found = true
+				if condition.Reason != ReasonPreemptionByScheduler {
+					t.Errorf("Expected DisruptionTarget reason %q, but received %q", ReasonPreemptionByScheduler, condition.Reason)
+				}
+			}
+		}
+		if !found {
+			t.Error("Expected a DisruptionTarget condition on the pod status, but none was found")
+		}
+	})
+
+	t.Run("CreatePod rolls back on RunTask failure", func(t *testing.T) {
+		if clusterID == nil || logGroupdID == nil || executorRoleID == nil || subnetID == nil {
+			t.Fatal("Can't start tests without all required being created.")
+		}
+		config := fmt.Sprintf(testConfig, testRegion, *clusterID, *logGroupdID, *executorRoleID, *subnetID)
+
+		tmpfile, err := ioutil.TempFile("", "example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmpfile.Name()) // clean up
+
+		if _, err = tmpfile.Write([]byte(config)); err != nil {
+			t.Fatal(err)
+		}
+		if err = tmpfile.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		provider, err := NewProvider(tmpfile.Name(), nil, "vk-aws-test", "Linux", "1.2.3.4", 10250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		provider.ecsClient = &runTaskFailingClient{ECSAPI: provider.ecsClient}
+
+		podName := fmt.Sprintf("test_fault_%d", time.Now().UnixNano()/1000)
+		family := taskFamily("default", podName)
+
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      podName,
+				Namespace: "default",
+				UID:       types.UID("unique-fault"),
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{v1.Container{
+					Name:  "echo-container",
+					Image: "busybox",
+					Command: []string{
+						"/bin/sh",
+					},
+					Args: []string{
+						"-c", "echo \"Started\"; while true; do sleep 1; done",
+					},
+					Resources: v1.ResourceRequirements{
+						Limits: v1.ResourceList{
+							v1.ResourceCPU:    resource.MustParse("200"),
+							v1.ResourceMemory: resource.MustParse("450Mi"),
+						},
+						Requests: v1.ResourceList{
+							v1.ResourceCPU:    resource.MustParse("100"),
+							v1.ResourceMemory: resource.MustParse("256Mi"),
+						},
+					},
+				}},
+			},
+		}
+
+		if err := provider.CreatePod(pod); err == nil {
+			t.Fatal("Expected CreatePod to fail when RunTask is faulted, but it succeeded")
+		}
+
+		descOutput, err := ecsClient.ListTaskDefinitions(&ecs.ListTaskDefinitionsInput{
+			FamilyPrefix: aws.String(family),
+			Status:       aws.String(ecs.TaskDefinitionStatusActive),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descOutput.TaskDefinitionArns) != 0 {
+			t.Errorf("Expected no active task definitions for family %q after a rolled-back CreatePod, but found %v", family, descOutput.TaskDefinitionArns)
+		}
+	})
+
+	t.Run("CreatePod rolls back on RunTask returning no tasks", func(t *testing.T) {
+		if clusterID == nil || logGroupdID == nil || executorRoleID == nil || subnetID == nil {
+			t.Fatal("Can't start tests without all required being created.")
+		}
+		config := fmt.Sprintf(testConfig, testRegion, *clusterID, *logGroupdID, *executorRoleID, *subnetID)
+
+		tmpfile, err := ioutil.TempFile("", "example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmpfile.Name()) // clean up
+
+		if _, err = tmpfile.Write([]byte(config)); err != nil {
+			t.Fatal(err)
+		}
+		if err = tmpfile.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		provider, err := NewProvider(tmpfile.Name(), nil, "vk-aws-test", "Linux", "1.2.3.4", 10250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		provider.ecsClient = &runTaskNoCapacityClient{ECSAPI: provider.ecsClient}
+
+		podName := fmt.Sprintf("test_nocapacity_%d", time.Now().UnixNano()/1000)
+		family := taskFamily("default", podName)
+
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      podName,
+				Namespace: "default",
+				UID:       types.UID("unique-nocapacity"),
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{v1.Container{
+					Name:  "echo-container",
+					Image: "busybox",
+					Command: []string{
+						"/bin/sh",
+					},
+					Args: []string{
+						"-c", "echo \"Started\"; while true; do sleep 1; done",
+					},
+					Resources: v1.ResourceRequirements{
+						Limits: v1.ResourceList{
+							v1.ResourceCPU:    resource.MustParse("200"),
+							v1.ResourceMemory: resource.MustParse("450Mi"),
+						},
+						Requests: v1.ResourceList{
+							v1.ResourceCPU:    resource.MustParse("100"),
+							v1.ResourceMemory: resource.MustParse("256Mi"),
+						},
+					},
+				}},
+			},
+		}
+
+		// A successful RunTask response with no Tasks and a populated
+		// Failures list (e.g. a Fargate capacity shortfall) must not panic
+		// CreatePod, and must still roll back the task definition it
+		// registered.
+		if err := provider.CreatePod(pod); err == nil {
+			t.Fatal("Expected CreatePod to fail when RunTask returns no tasks, but it succeeded")
+		}
+
+		descOutput, err := ecsClient.ListTaskDefinitions(&ecs.ListTaskDefinitionsInput{
+			FamilyPrefix: aws.String(family),
+			Status:       aws.String(ecs.TaskDefinitionStatusActive),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descOutput.TaskDefinitionArns) != 0 {
+			t.Errorf("Expected no active task definitions for family %q after a rolled-back CreatePod, but found %v", family, descOutput.TaskDefinitionArns)
+		}
+	})
+
+	t.Run("Multi-container pod with init container and health checks", func(t *testing.T) {
+		if clusterID == nil || logGroupdID == nil || executorRoleID == nil || subnetID == nil {
+			t.Fatal("Can't start tests without all required being created.")
+		}
+		config := fmt.Sprintf(testConfig, testRegion, *clusterID, *logGroupdID, *executorRoleID, *subnetID)
+
+		tmpfile, err := ioutil.TempFile("", "example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmpfile.Name()) // clean up
+
+		if _, err = tmpfile.Write([]byte(config)); err != nil {
+			t.Fatal(err)
+		}
+		if err = tmpfile.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		provider, err := NewProvider(tmpfile.Name(), nil, "vk-aws-test", "Linux", "1.2.3.4", 10250)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		podName := fmt.Sprintf("test_multi_%d", time.Now().UnixNano()/1000)
+
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      podName,
+				Namespace: "default",
+				UID:       types.UID("unique-multi"),
+				Annotations: map[string]string{
+					sidecarAnnotation: "sidecar-container",
+				},
+			},
+			Spec: v1.PodSpec{
+				InitContainers: []v1.Container{{
+					Name:    "init-container",
+					Image:   "busybox",
+					Command: []string{"/bin/sh"},
+					Args:    []string{"-c", "echo \"Initialized\""},
+					Resources: v1.ResourceRequirements{
+						Limits:   v1.ResourceList{v1.ResourceMemory: resource.MustParse("64Mi")},
+						Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("10")},
+					},
+				}},
+				Containers: []v1.Container{
+					{
+						Name:  "echo-container",
+						Image: "busybox",
+						Command: []string{
+							"/bin/sh",
+						},
+						Args: []string{
+							"-c", "echo \"Started\"; while true; do sleep 1; done",
+						},
+						ReadinessProbe: &v1.Probe{
+							Handler: v1.Handler{
+								Exec: &v1.ExecAction{Command: []string{"true"}},
+							},
+						},
+						Resources: v1.ResourceRequirements{
+							Limits: v1.ResourceList{
+								v1.ResourceCPU:    resource.MustParse("200"),
+								v1.ResourceMemory: resource.MustParse("450Mi"),
+							},
+							Requests: v1.ResourceList{
+								v1.ResourceCPU:    resource.MustParse("100"),
+								v1.ResourceMemory: resource.MustParse("256Mi"),
+							},
+						},
+					},
+					{
+						Name:  "sidecar-container",
+						Image: "busybox",
+						Command: []string{
+							"/bin/sh",
+						},
+						Args: []string{
+							"-c", "exit 1",
+						},
+						Resources: v1.ResourceRequirements{
+							Limits:   v1.ResourceList{v1.ResourceMemory: resource.MustParse("64Mi")},
+							Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("10")},
+						},
+					},
+				},
+			},
+		}
+
+		err = provider.CreatePod(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = waitUntilPodStatus(provider, podName, v1.PodRunning)
+		if err != nil {
+			t.Error(err)
+		}
+
+		status, err := provider.GetPodStatus("default", podName)
+		if err != nil {
+			t.Error(err)
+		}
+		if status == nil || status.Phase != v1.PodRunning {
+			t.Errorf("Expected the pod to still be Running despite the sidecar exiting, but got %v", status)
+		}
+
+		err = provider.DeletePod(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
 	_, err = ecsClient.DeleteCluster(&ecs.DeleteClusterInput{
 		Cluster: clusterID,
 	})
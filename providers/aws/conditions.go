@@ -0,0 +1,87 @@
+package aws
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PodConditionDisruptionTarget mirrors the upstream Kubernetes
+// DisruptionTarget PodConditionType: it tells Job/ReplicaSet controllers
+// that a pod went away because of infrastructure disruption rather than a
+// genuine application failure, so they don't count it against backoff
+// limits the way they would a crash.
+const PodConditionDisruptionTarget v1.PodConditionType = "DisruptionTarget"
+
+// Disruption condition reasons. ReasonTerminationByKubelet and
+// ReasonPreemptionByScheduler echo the reason strings upstream kubelet uses
+// for analogous in-cluster events; ReasonECSTaskFailure has no in-cluster
+// analogue, since it covers failures ECS itself detected (OOM, essential
+// container exit) rather than ones the scheduler or node induced.
+const (
+	ReasonTerminationByKubelet  = "TerminationByKubelet"
+	ReasonECSTaskFailure        = "ECSTaskFailure"
+	ReasonPreemptionByScheduler = "PreemptionByScheduler"
+)
+
+// disruptionConditionForTask inspects why ECS stopped task and, if the stop
+// was out-of-band (not a DeletePod-initiated StopTask call) and its stop code
+// or reason is one disruptionReasonForTask recognizes, returns the
+// DisruptionTarget condition that should be attached to the pod's status.
+// It returns nil for a DeletePod-initiated stop and for any stop whose
+// reason is not recognized.
+func disruptionConditionForTask(task *ecs.Task) *v1.PodCondition {
+	reason := disruptionReasonForTask(task)
+	if reason == "" {
+		return nil
+	}
+
+	condition := &v1.PodCondition{
+		Type:    PodConditionDisruptionTarget,
+		Status:  v1.ConditionTrue,
+		Reason:  reason,
+		Message: aws.StringValue(task.StoppedReason),
+	}
+	if task.StoppedAt != nil {
+		condition.LastTransitionTime = metav1.NewTime(*task.StoppedAt)
+	} else {
+		condition.LastTransitionTime = metav1.NewTime(time.Now())
+	}
+
+	return condition
+}
+
+func disruptionReasonForTask(task *ecs.Task) string {
+	stoppedReason := aws.StringValue(task.StoppedReason)
+	if stoppedReason == podDeletedStopReason {
+		// DeletePod stopped this task itself; not a disruption.
+		return ""
+	}
+
+	lowerReason := strings.ToLower(stoppedReason)
+
+	switch {
+	// Capacity-provider-initiated stops are worded "Scaling activity
+	// initiated by (capacity provider ...)", so this case must be checked
+	// before the "scaling activity" one below or it's unreachable.
+	case strings.Contains(lowerReason, "capacity provider"):
+		return ReasonPreemptionByScheduler
+
+	case aws.StringValue(task.StopCode) == ecs.TaskStopCodeSpotInterruption,
+		strings.Contains(lowerReason, "spot interruption"),
+		strings.Contains(lowerReason, "scaling activity"):
+		return ReasonTerminationByKubelet
+
+	case aws.StringValue(task.StopCode) == ecs.TaskStopCodeEssentialContainerExited,
+		strings.Contains(lowerReason, "outofmemory"),
+		strings.Contains(lowerReason, "out of memory"):
+		return ReasonECSTaskFailure
+
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,28 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDisruptionReasonForTaskCapacityProvider(t *testing.T) {
+	task := &ecs.Task{
+		StoppedReason: aws.String("Scaling activity initiated by (capacity provider vk-aws-e2e-test-cp)"),
+	}
+
+	if reason := disruptionReasonForTask(task); reason != ReasonPreemptionByScheduler {
+		t.Errorf("expected %q for a capacity-provider stop, got %q", ReasonPreemptionByScheduler, reason)
+	}
+}
+
+func TestDisruptionReasonForTaskScalingActivity(t *testing.T) {
+	task := &ecs.Task{
+		StoppedReason: aws.String("Scaling activity initiated by (deregister ASG instance)"),
+	}
+
+	if reason := disruptionReasonForTask(task); reason != ReasonTerminationByKubelet {
+		t.Errorf("expected %q for a non-capacity-provider scaling stop, got %q", ReasonTerminationByKubelet, reason)
+	}
+}
@@ -0,0 +1,54 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config is the user-supplied configuration for the AWS ECS provider, loaded
+// from a TOML file at the path passed to NewProvider.
+type Config struct {
+	Region             string   `toml:"Region"`
+	Cluster            string   `toml:"Cluster"`
+	CloudWatchLogGroup string   `toml:"CloudWatchLogGroup"`
+	ExecutionRoleArn   string   `toml:"ExecutionRoleArn"`
+	Subnets            []string `toml:"Subnets"`
+	SecurityGroups     []string `toml:"SecurityGroups"`
+
+	// LoadBalancerArn and ListenerArn point at a pre-existing ALB/NLB and
+	// listener that the provider registers per-pod target groups and rules
+	// against. Both are optional: pods that don't declare containerPorts
+	// never touch the load balancer.
+	LoadBalancerArn string `toml:"LoadBalancerArn"`
+	ListenerArn     string `toml:"ListenerArn"`
+
+	// RulePriorityStart is the first listener rule priority the provider
+	// will try to allocate; it then probes upward for the next unused one.
+	// Defaults to 1 if unset.
+	RulePriorityStart int `toml:"RulePriorityStart"`
+}
+
+// loadConfig reads and validates the provider configuration at configPath.
+func loadConfig(configPath string) (Config, error) {
+	var config Config
+
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		return config, fmt.Errorf("unable to decode AWS provider config %q: %v", configPath, err)
+	}
+
+	if config.Region == "" {
+		return config, fmt.Errorf("AWS provider config is missing a Region")
+	}
+	if config.Cluster == "" {
+		return config, fmt.Errorf("AWS provider config is missing a Cluster")
+	}
+	if len(config.Subnets) == 0 {
+		return config, fmt.Errorf("AWS provider config must specify at least one Subnet")
+	}
+	if config.RulePriorityStart == 0 {
+		config.RulePriorityStart = 1
+	}
+
+	return config, nil
+}
@@ -0,0 +1,59 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// runExecCommand runs command inside containerName of task, the same way
+// `aws ecs execute-command` does: it opens an ECS exec session via the API,
+// then hands the session off to the session-manager-plugin binary to drive
+// the encrypted data channel. It blocks until the command returns or timeout
+// elapses, whichever comes first.
+//
+// This requires the session-manager-plugin binary to be on PATH, same as
+// it does for the AWS CLI.
+func (p *Provider) runExecCommand(ctx context.Context, cluster, taskArn, containerName, command string, timeout time.Duration) error {
+	execCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// ECS ExecuteCommand only supports interactive sessions; a non-interactive
+	// request is rejected by the API.
+	out, err := p.ecsClient.ExecuteCommandWithContext(execCtx, &ecs.ExecuteCommandInput{
+		Cluster:     aws.String(cluster),
+		Task:        aws.String(taskArn),
+		Container:   aws.String(containerName),
+		Command:     aws.String(command),
+		Interactive: aws.Bool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to start exec session in container %q: %v", containerName, err)
+	}
+
+	sessionJSON, err := json.Marshal(out.Session)
+	if err != nil {
+		return fmt.Errorf("unable to marshal exec session: %v", err)
+	}
+
+	target := fmt.Sprintf("ecs:%s_%s_%s", clusterNameFromArn(cluster), taskIDFromArn(taskArn), containerName)
+
+	cmd := exec.CommandContext(execCtx, "session-manager-plugin",
+		string(sessionJSON),
+		p.config.Region,
+		"StartSession",
+		"",
+		target,
+	)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("exec session for container %q exited with error: %v", containerName, err)
+	}
+
+	return nil
+}
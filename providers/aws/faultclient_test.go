@@ -0,0 +1,39 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+// runTaskFailingClient wraps a real ecsiface.ECSAPI and makes every RunTask
+// call fail, so tests can exercise CreatePod's cleanup path without an
+// actual AWS outage.
+type runTaskFailingClient struct {
+	ecsiface.ECSAPI
+}
+
+func (c *runTaskFailingClient) RunTask(input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error) {
+	return nil, fmt.Errorf("injected fault: RunTask always fails in this test")
+}
+
+// runTaskNoCapacityClient wraps a real ecsiface.ECSAPI and makes every
+// RunTask call return ECS's documented "no error, but no task either"
+// response (e.g. a RESOURCE:FARGATE capacity failure), so tests can exercise
+// CreatePod's handling of a successful-but-empty RunTask result.
+type runTaskNoCapacityClient struct {
+	ecsiface.ECSAPI
+}
+
+func (c *runTaskNoCapacityClient) RunTask(input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error) {
+	return &ecs.RunTaskOutput{
+		Failures: []*ecs.Failure{
+			{
+				Arn:    input.TaskDefinition,
+				Reason: aws.String("RESOURCE:FARGATE"),
+			},
+		},
+	}, nil
+}
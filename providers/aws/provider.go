@@ -0,0 +1,433 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/johanneswuerbach/virtual-kubelet/manager"
+	"k8s.io/api/core/v1"
+)
+
+// defaultTerminationGracePeriod is used for the PreStop hook timeout when a
+// pod does not specify its own TerminationGracePeriodSeconds.
+const defaultTerminationGracePeriod = 30 * time.Second
+
+// podDeletedStopReason is passed to ECS StopTask by DeletePod, and is used
+// by disruptionReasonForTask to recognize a provider-initiated stop so it
+// isn't mistaken for an out-of-band disruption.
+const podDeletedStopReason = "pod deleted"
+
+// taskENIPollInterval/taskENITimeout bound how long CreatePod waits for
+// Fargate to attach an ENI (and hence a private IP) to a newly run task.
+const (
+	taskENIPollInterval = 3 * time.Second
+	taskENITimeout      = 2 * time.Minute
+)
+
+// Provider implements the virtual-kubelet provider interface for AWS ECS:
+// pods are translated to ECS task definitions and run as ECS tasks.
+type Provider struct {
+	// ecsClient is ecsiface.ECSAPI rather than the concrete *ecs.ECS so that
+	// tests can wrap it to inject faults (e.g. a RunTask that always fails)
+	// without touching real AWS resources.
+	ecsClient            ecsiface.ECSAPI
+	cloudwatchLogsClient *cloudwatchlogs.CloudWatchLogs
+	ec2Client            *ec2.EC2
+	elbv2Client          *elbv2.ELBV2
+	resourceManager      *manager.ResourceManager
+
+	// ingressRefCounts and ingressRefCountsMu guard the shared, provider-wide
+	// ALB security group rules: every pod exposing the same containerPort on
+	// the same configured security group authorizes the same rule, so a
+	// count (rather than the rule's mere existence) is what tells CreatePod's
+	// rollback whether a sibling pod still depends on it. See restrictIngressToALB.
+	ingressRefCounts   map[string]int
+	ingressRefCountsMu sync.Mutex
+
+	config Config
+
+	nodeName           string
+	operatingSystem    string
+	internalIP         string
+	daemonEndpointPort int32
+}
+
+// NewProvider creates a new AWS ECS provider, reading its configuration from
+// the TOML file at configPath.
+func NewProvider(configPath string, rm *manager.ResourceManager, nodeName, operatingSystem, internalIP string, daemonEndpointPort int32) (*Provider, error) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(config.Region),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create AWS session: %v", err)
+	}
+
+	return &Provider{
+		ecsClient:            ecs.New(sess),
+		cloudwatchLogsClient: cloudwatchlogs.New(sess),
+		ec2Client:            ec2.New(sess),
+		elbv2Client:          elbv2.New(sess),
+		resourceManager:      rm,
+		ingressRefCounts:     map[string]int{},
+		config:               config,
+		nodeName:             nodeName,
+		operatingSystem:      operatingSystem,
+		internalIP:           internalIP,
+		daemonEndpointPort:   daemonEndpointPort,
+	}, nil
+}
+
+// CreatePod registers a task definition for pod and runs it as an ECS task.
+// Every AWS resource it creates along the way is recorded on a
+// resourceTracker; if any step fails, everything recorded so far is rolled
+// back before the error is returned, so a failure partway through (e.g.
+// RunTask rejecting the task) can't leak a task definition, log stream, or
+// ALB target group.
+func (p *Provider) CreatePod(pod *v1.Pod) error {
+	tracker := newResourceTracker()
+
+	if err := p.createPod(pod, tracker); err != nil {
+		if cleanupErr := tracker.unwind(); cleanupErr != nil {
+			return fmt.Errorf("%v (cleanup also failed: %v)", err, cleanupErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (p *Provider) createPod(pod *v1.Pod, tracker *resourceTracker) error {
+	taskDefInput, err := podToTaskDefinitionInput(pod, p.config)
+	if err != nil {
+		return err
+	}
+
+	registerOutput, err := p.ecsClient.RegisterTaskDefinition(taskDefInput)
+	if err != nil {
+		return fmt.Errorf("unable to register task definition for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	taskDef := registerOutput.TaskDefinition
+	taskDefID := fmt.Sprintf("%s:%d", *taskDef.Family, *taskDef.Revision)
+	tracker.record(fmt.Sprintf("deregister task definition %s", taskDefID), func() error {
+		_, err := p.ecsClient.DeregisterTaskDefinition(&ecs.DeregisterTaskDefinitionInput{
+			TaskDefinition: aws.String(taskDefID),
+		})
+		return err
+	})
+
+	runOutput, err := p.ecsClient.RunTask(&ecs.RunTaskInput{
+		Cluster:        aws.String(p.config.Cluster),
+		TaskDefinition: aws.String(taskDefID),
+		LaunchType:     aws.String(ecs.LaunchTypeFargate),
+		Count:          aws.Int64(1),
+		NetworkConfiguration: &ecs.NetworkConfiguration{
+			AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
+				Subnets:        aws.StringSlice(p.config.Subnets),
+				SecurityGroups: aws.StringSlice(p.config.SecurityGroups),
+				AssignPublicIp: aws.String(ecs.AssignPublicIpEnabled),
+			},
+		},
+		Tags: []*ecs.Tag{
+			{Key: aws.String("PodNamespace"), Value: aws.String(pod.Namespace)},
+			{Key: aws.String("PodName"), Value: aws.String(pod.Name)},
+			{Key: aws.String("PodUID"), Value: aws.String(string(pod.UID))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to run task for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	if len(runOutput.Tasks) == 0 {
+		return fmt.Errorf("unable to run task for pod %s/%s: %v", pod.Namespace, pod.Name, runOutput.Failures)
+	}
+	taskArn := *runOutput.Tasks[0].TaskArn
+	tracker.record(fmt.Sprintf("stop task %s", taskArn), func() error {
+		_, err := p.ecsClient.StopTask(&ecs.StopTaskInput{
+			Cluster: aws.String(p.config.Cluster),
+			Task:    aws.String(taskArn),
+			Reason:  aws.String("rolled back after CreatePod failure"),
+		})
+		if isNotFoundErr(err) {
+			return nil
+		}
+		return err
+	})
+
+	for _, logStream := range logStreamNamesForPod(taskDef, taskArn) {
+		logStream := logStream
+		tracker.record(fmt.Sprintf("delete log stream %s", logStream), func() error {
+			return p.deleteLogStreamIgnoreNotFound(logStream)
+		})
+	}
+
+	if len(containerPorts(pod)) > 0 {
+		privateIP, err := p.waitForTaskENI(taskArn)
+		if err != nil {
+			return fmt.Errorf("unable to determine private IP for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+		if err := p.ingressForPod(pod, privateIP, tracker); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// logStreamNamesForPod predicts the awslogs stream name the ECS agent will
+// use for each container, following the "ecs/<container>/<task-id>"
+// stream-prefix convention podToTaskDefinitionInput configures and
+// GetContainerLogs reads back from.
+func logStreamNamesForPod(taskDef *ecs.TaskDefinition, taskArn string) []string {
+	taskID := taskIDFromArn(taskArn)
+	names := make([]string, 0, len(taskDef.ContainerDefinitions))
+	for _, def := range taskDef.ContainerDefinitions {
+		names = append(names, fmt.Sprintf("ecs/%s/%s", aws.StringValue(def.Name), taskID))
+	}
+	return names
+}
+
+func (p *Provider) deleteLogStreamIgnoreNotFound(logStreamName string) error {
+	_, err := p.cloudwatchLogsClient.DeleteLogStream(&cloudwatchlogs.DeleteLogStreamInput{
+		LogGroupName:  aws.String(p.config.CloudWatchLogGroup),
+		LogStreamName: aws.String(logStreamName),
+	})
+	if isNotFoundErr(err) {
+		return nil
+	}
+	return err
+}
+
+// waitForTaskENI polls taskArn until Fargate has attached an ENI and
+// assigned it a private IPv4 address, or taskENITimeout elapses.
+func (p *Provider) waitForTaskENI(taskArn string) (string, error) {
+	deadline := time.Now().Add(taskENITimeout)
+	for {
+		output, err := p.ecsClient.DescribeTasks(&ecs.DescribeTasksInput{
+			Cluster: aws.String(p.config.Cluster),
+			Tasks:   []*string{aws.String(taskArn)},
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(output.Tasks) == 1 {
+			if ip := taskPrivateIP(output.Tasks[0]); ip != "" {
+				return ip, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out waiting for ENI attachment on task %s", taskArn)
+		}
+		time.Sleep(taskENIPollInterval)
+	}
+}
+
+// taskPrivateIP extracts the private IPv4 address of task's ENI attachment,
+// or "" if it has not been assigned one yet.
+func taskPrivateIP(task *ecs.Task) string {
+	for _, attachment := range task.Attachments {
+		for _, detail := range attachment.Details {
+			if aws.StringValue(detail.Name) == "privateIPv4Address" {
+				return aws.StringValue(detail.Value)
+			}
+		}
+	}
+	return ""
+}
+
+// DeletePod runs each container's PreStop hook (if any), bounded by the
+// pod's TerminationGracePeriodSeconds, and then stops the ECS task backing
+// pod. The pod must not be observed as Succeeded by GetPodStatus until this
+// has happened, mirroring kubelet semantics.
+//
+// A PreStop hook that fails or overruns the grace period does not prevent
+// the task from being stopped: like kubelet force-killing a container once
+// its grace period expires, StopTask runs once the hooks have had their
+// chance. Hook failures are collected and returned alongside (rather than
+// instead of) the stop, so the caller still sees them. A failure to remove
+// the pod's load balancer ingress, by contrast, is returned before StopTask
+// is called.
+func (p *Provider) DeletePod(pod *v1.Pod) error {
+	task, err := p.lookupTask(pod.Namespace, pod.Name)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		return fmt.Errorf("no running task found for pod %s/%s", pod.Namespace, pod.Name)
+	}
+
+	grace := defaultTerminationGracePeriod
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		grace = time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second
+	}
+
+	var hookErrs []error
+	for _, container := range pod.Spec.Containers {
+		if container.Lifecycle == nil || container.Lifecycle.PreStop == nil {
+			continue
+		}
+
+		hookCmd, err := lifecycleHandlerToShellCommand(container.Lifecycle.PreStop)
+		if err != nil {
+			hookErrs = append(hookErrs, fmt.Errorf("unable to translate PreStop hook for container %q: %v", container.Name, err))
+			continue
+		}
+
+		if err := p.runExecCommand(context.Background(), p.config.Cluster, *task.TaskArn, container.Name, hookCmd, grace); err != nil {
+			hookErrs = append(hookErrs, fmt.Errorf("PreStop hook for container %q failed: %v", container.Name, err))
+		}
+	}
+
+	if err := p.deleteIngressForPod(pod); err != nil {
+		return fmt.Errorf("unable to remove load balancer ingress for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	_, err = p.ecsClient.StopTask(&ecs.StopTaskInput{
+		Cluster: aws.String(p.config.Cluster),
+		Task:    task.TaskArn,
+		Reason:  aws.String(podDeletedStopReason),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to stop task for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	if len(hookErrs) > 0 {
+		return fmt.Errorf("task for pod %s/%s was stopped, but %d PreStop hook(s) failed: %v", pod.Namespace, pod.Name, len(hookErrs), hookErrs[0])
+	}
+
+	return nil
+}
+
+// GetPods lists every ECS task this provider has running and translates
+// each one back into a v1.Pod shell.
+func (p *Provider) GetPods() ([]*v1.Pod, error) {
+	listOutput, err := p.ecsClient.ListTasks(&ecs.ListTasksInput{
+		Cluster: aws.String(p.config.Cluster),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tasks: %v", err)
+	}
+	if len(listOutput.TaskArns) == 0 {
+		return []*v1.Pod{}, nil
+	}
+
+	describeOutput, err := p.ecsClient.DescribeTasks(&ecs.DescribeTasksInput{
+		Cluster: aws.String(p.config.Cluster),
+		Tasks:   listOutput.TaskArns,
+		Include: aws.StringSlice([]string{ecs.TaskFieldTags}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe tasks: %v", err)
+	}
+
+	pods := make([]*v1.Pod, 0, len(describeOutput.Tasks))
+	for _, task := range describeOutput.Tasks {
+		pod, err := p.taskToPod(task)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, pod)
+	}
+
+	return pods, nil
+}
+
+// GetPodStatus returns the current status of the pod named namespace/name,
+// or nil if no task backs it (any more).
+func (p *Provider) GetPodStatus(namespace, name string) (*v1.PodStatus, error) {
+	task, err := p.lookupTask(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if task == nil {
+		return nil, nil
+	}
+
+	return p.taskToPodStatus(task)
+}
+
+// GetContainerLogs returns the tail of containerName's CloudWatch log
+// stream for the pod named namespace/name.
+func (p *Provider) GetContainerLogs(namespace, name, containerName string, tail int) (string, error) {
+	task, err := p.lookupTask(namespace, name)
+	if err != nil {
+		return "", err
+	}
+	if task == nil {
+		return "", fmt.Errorf("no task found for pod %s/%s", namespace, name)
+	}
+
+	streamName := fmt.Sprintf("ecs/%s/%s", containerName, taskIDFromArn(*task.TaskArn))
+
+	output, err := p.cloudwatchLogsClient.GetLogEvents(&cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(p.config.CloudWatchLogGroup),
+		LogStreamName: aws.String(streamName),
+		Limit:         aws.Int64(int64(tail)),
+		StartFromHead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch logs for container %q: %v", containerName, err)
+	}
+
+	var sb strings.Builder
+	for _, event := range output.Events {
+		sb.WriteString(*event.Message)
+		sb.WriteString("\n")
+	}
+
+	return sb.String(), nil
+}
+
+// lookupTask finds the single running or recently-stopped task backing the
+// pod named namespace/name, or nil if none exists.
+func (p *Provider) lookupTask(namespace, name string) (*ecs.Task, error) {
+	family := taskFamily(namespace, name)
+
+	listOutput, err := p.ecsClient.ListTasks(&ecs.ListTasksInput{
+		Cluster: aws.String(p.config.Cluster),
+		Family:  aws.String(family),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tasks for pod %s/%s: %v", namespace, name, err)
+	}
+	if len(listOutput.TaskArns) == 0 {
+		return nil, nil
+	}
+
+	describeOutput, err := p.ecsClient.DescribeTasks(&ecs.DescribeTasksInput{
+		Cluster: aws.String(p.config.Cluster),
+		Tasks:   listOutput.TaskArns,
+		Include: aws.StringSlice([]string{ecs.TaskFieldTags}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe tasks for pod %s/%s: %v", namespace, name, err)
+	}
+	if len(describeOutput.Tasks) == 0 {
+		return nil, nil
+	}
+
+	return describeOutput.Tasks[0], nil
+}
+
+func clusterNameFromArn(clusterArnOrName string) string {
+	parts := strings.Split(clusterArnOrName, "/")
+	return parts[len(parts)-1]
+}
+
+func taskIDFromArn(taskArn string) string {
+	parts := strings.Split(taskArn, "/")
+	return parts[len(parts)-1]
+}
@@ -0,0 +1,107 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Reconcile garbage-collects AWS resources left behind by a CreatePod that
+// crashed before it could run its own cleanup (e.g. the provider process
+// itself was killed mid-Create). It should be called once by the virtual
+// kubelet main loop on startup, before the provider starts serving pods.
+//
+// It lists every task this provider tagged with a pod UID, and for any
+// whose UID no longer corresponds to a pod the Kubernetes API knows about,
+// stops the task, deregisters its task definition, and tears down any ALB
+// listener rule and target group created for the same pod.
+//
+// Reconcile requires a resource manager so it can tell "no pods known yet"
+// apart from "every pod is orphaned"; it refuses to run without one rather
+// than risk reaping every task in the cluster.
+//
+// It also reseeds the provider's in-memory ALB ingress rule reference counts
+// from the pods known about, since those counts reset to zero across a
+// process restart even though the AWS rules they track don't; running this
+// before CreatePod/DeletePod can touch the counts keeps a restart from
+// looking like every shared rule has exactly one, brand-new owner.
+func (p *Provider) Reconcile() error {
+	if p.resourceManager == nil {
+		return fmt.Errorf("unable to reconcile: no resource manager configured, refusing to treat every running task as orphaned")
+	}
+
+	pods, err := p.resourceManager.GetPods()
+	if err != nil {
+		return fmt.Errorf("unable to list known pods for reconciliation: %v", err)
+	}
+	p.rebuildIngressRefCounts(pods)
+
+	knownUIDs := map[string]bool{}
+	for _, pod := range pods {
+		knownUIDs[string(pod.UID)] = true
+	}
+
+	listOutput, err := p.ecsClient.ListTasks(&ecs.ListTasksInput{
+		Cluster: aws.String(p.config.Cluster),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list tasks for reconciliation: %v", err)
+	}
+	if len(listOutput.TaskArns) == 0 {
+		return nil
+	}
+
+	describeOutput, err := p.ecsClient.DescribeTasks(&ecs.DescribeTasksInput{
+		Cluster: aws.String(p.config.Cluster),
+		Tasks:   listOutput.TaskArns,
+		Include: aws.StringSlice([]string{ecs.TaskFieldTags}),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to describe tasks for reconciliation: %v", err)
+	}
+
+	var errs []error
+	for _, task := range describeOutput.Tasks {
+		namespace, name, uid := podIdentityFromTags(task.Tags)
+		if uid == "" || knownUIDs[uid] {
+			continue
+		}
+
+		if err := p.reapOrphanedTask(task, namespace, name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("reconciliation left %d orphaned task(s) behind: %v", len(errs), errs[0])
+	}
+	return nil
+}
+
+func (p *Provider) reapOrphanedTask(task *ecs.Task, namespace, name string) error {
+	if aws.StringValue(task.LastStatus) != ecs.DesiredStatusStopped {
+		if _, err := p.ecsClient.StopTask(&ecs.StopTaskInput{
+			Cluster: aws.String(p.config.Cluster),
+			Task:    task.TaskArn,
+			Reason:  aws.String("reconciled: pod no longer exists"),
+		}); err != nil {
+			return fmt.Errorf("unable to stop orphaned task %s: %v", aws.StringValue(task.TaskArn), err)
+		}
+	}
+
+	if _, err := p.ecsClient.DeregisterTaskDefinition(&ecs.DeregisterTaskDefinitionInput{
+		TaskDefinition: task.TaskDefinitionArn,
+	}); err != nil {
+		return fmt.Errorf("unable to deregister orphaned task definition %s: %v", aws.StringValue(task.TaskDefinitionArn), err)
+	}
+
+	orphanPod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	if err := p.deleteIngressForPod(orphanPod); err != nil {
+		return fmt.Errorf("unable to remove orphaned ALB ingress for %s/%s: %v", namespace, name, err)
+	}
+
+	return nil
+}
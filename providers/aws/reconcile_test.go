@@ -0,0 +1,11 @@
+package aws
+
+import "testing"
+
+func TestReconcileRequiresResourceManager(t *testing.T) {
+	p := &Provider{}
+
+	if err := p.Reconcile(); err == nil {
+		t.Fatal("expected Reconcile to fail without a resource manager, instead of treating every running task as orphaned")
+	}
+}
@@ -0,0 +1,65 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxCompensatingRetries bounds how many times in total resourceTracker
+// attempts a single compensating delete before giving up on it and moving on to the
+// next one; cleanup should be best-effort, not block forever.
+const maxCompensatingRetries = 3
+
+// resourceTracker records every AWS API side effect CreatePod performs for
+// a single pod, so that if any later step fails, everything created so far
+// can be torn down again in reverse order. Without this, a failure midway
+// through CreatePod (e.g. RunTask rejecting the task definition) leaves
+// orphaned task definitions, target groups, or log streams behind.
+type resourceTracker struct {
+	actions []compensatingAction
+}
+
+type compensatingAction struct {
+	description string
+	undo        func() error
+}
+
+func newResourceTracker() *resourceTracker {
+	return &resourceTracker{}
+}
+
+// record appends a compensating action. undo is expected to be idempotent
+// and to treat "already gone" as success, since unwind may run it after a
+// partially-applied create or a retry of a previous unwind.
+func (t *resourceTracker) record(description string, undo func() error) {
+	t.actions = append(t.actions, compensatingAction{description: description, undo: undo})
+}
+
+// unwind runs every recorded action in reverse order (most recent side
+// effect first), attempting each up to maxCompensatingRetries times. It keeps
+// going even if one action never succeeds, so a single stuck resource
+// doesn't prevent cleanup of everything else.
+func (t *resourceTracker) unwind() error {
+	var failures []string
+
+	for i := len(t.actions) - 1; i >= 0; i-- {
+		action := t.actions[i]
+
+		var err error
+		for attempt := 0; attempt < maxCompensatingRetries; attempt++ {
+			if err = action.undo(); err == nil {
+				break
+			}
+			time.Sleep(time.Duration(attempt+1) * time.Second)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", action.description, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("cleanup left resources behind: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// postStartSentinel is touched inside the container, after the PostStart
+// hook returns and before the real process is exec'd, so that tooling
+// inspecting a running container can tell the hook has completed.
+const postStartSentinel = "/tmp/.vk-poststart-complete"
+
+var invalidFamilyChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// taskFamily derives the ECS task definition family for a pod. It is also
+// used as the lookup key for finding the running task for a pod later, so
+// it must be a pure function of namespace/name.
+func taskFamily(namespace, name string) string {
+	return "vk-" + invalidFamilyChars.ReplaceAllString(namespace+"-"+name, "-")
+}
+
+// sidecarAnnotation lists the pod.Spec.Containers names that should run as
+// ECS non-essential containers, the closest ECS equivalent to a Kubernetes
+// sidecar: the task is allowed to keep running, and is not considered
+// failed, when one of these exits. There's no ECS-native notion of a
+// sidecar, so this is the provider's own extension point.
+const sidecarAnnotation = "virtual-kubelet.io/sidecar-containers"
+
+// podToTaskDefinitionInput translates a v1.Pod into the RegisterTaskDefinition
+// request that will back it: one ECS container per pod container, plus one
+// per init container, wired together with dependsOn so init containers run
+// to completion before the rest of the task starts.
+func podToTaskDefinitionInput(pod *v1.Pod, config Config) (*ecs.RegisterTaskDefinitionInput, error) {
+	sidecars := sidecarNames(pod)
+
+	containerDefinitions := make([]*ecs.ContainerDefinition, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+
+	var previousInit string
+	for _, container := range pod.Spec.InitContainers {
+		var dependsOn []*ecs.ContainerDependency
+		if previousInit != "" {
+			dependsOn = []*ecs.ContainerDependency{containerSuccessDependency(previousInit)}
+		}
+
+		def, err := containerToContainerDefinition(container, config, false, dependsOn)
+		if err != nil {
+			return nil, fmt.Errorf("unable to translate init container %q: %v", container.Name, err)
+		}
+		containerDefinitions = append(containerDefinitions, def)
+		previousInit = container.Name
+	}
+
+	var appDependsOn []*ecs.ContainerDependency
+	if previousInit != "" {
+		appDependsOn = []*ecs.ContainerDependency{containerSuccessDependency(previousInit)}
+	}
+
+	for _, container := range pod.Spec.Containers {
+		def, err := containerToContainerDefinition(container, config, !sidecars[container.Name], appDependsOn)
+		if err != nil {
+			return nil, fmt.Errorf("unable to translate container %q: %v", container.Name, err)
+		}
+		containerDefinitions = append(containerDefinitions, def)
+	}
+
+	input := &ecs.RegisterTaskDefinitionInput{
+		Family:                  aws.String(taskFamily(pod.Namespace, pod.Name)),
+		NetworkMode:             aws.String(ecs.NetworkModeAwsvpc),
+		RequiresCompatibilities: aws.StringSlice([]string{ecs.CompatibilityFargate}),
+		ExecutionRoleArn:        aws.String(config.ExecutionRoleArn),
+		Cpu:                     aws.String(taskCPU(pod)),
+		Memory:                  aws.String(taskMemory(pod)),
+		ContainerDefinitions:    containerDefinitions,
+	}
+
+	if pod.Spec.ShareProcessNamespace != nil && *pod.Spec.ShareProcessNamespace {
+		input.PidMode = aws.String(ecs.PidModeTask)
+	}
+
+	return input, nil
+}
+
+func containerSuccessDependency(containerName string) *ecs.ContainerDependency {
+	return &ecs.ContainerDependency{
+		ContainerName: aws.String(containerName),
+		Condition:     aws.String(ecs.ContainerConditionSuccess),
+	}
+}
+
+func sidecarNames(pod *v1.Pod) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(pod.Annotations[sidecarAnnotation], ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// containerToContainerDefinition translates a single v1.Container, wrapping
+// its entrypoint to run the PostStart lifecycle hook (if any) before the
+// container's real command is exec'd, and propagating its probes and
+// dependsOn ordering.
+func containerToContainerDefinition(container v1.Container, config Config, essential bool, dependsOn []*ecs.ContainerDependency) (*ecs.ContainerDefinition, error) {
+	entryPoint := aws.StringSlice(container.Command)
+	command := aws.StringSlice(container.Args)
+
+	if container.Lifecycle != nil && container.Lifecycle.PostStart != nil {
+		wrapped, err := wrapEntrypointWithPostStart(container)
+		if err != nil {
+			return nil, fmt.Errorf("unable to translate PostStart hook: %v", err)
+		}
+		entryPoint = aws.StringSlice([]string{"/bin/sh", "-c"})
+		command = aws.StringSlice([]string{wrapped})
+	}
+
+	def := &ecs.ContainerDefinition{
+		Name:         aws.String(container.Name),
+		Image:        aws.String(container.Image),
+		EntryPoint:   entryPoint,
+		Command:      command,
+		Cpu:          aws.Int64(container.Resources.Requests.Cpu().MilliValue() / 1000),
+		Memory:       aws.Int64(container.Resources.Limits.Memory().Value() / (1024 * 1024)),
+		Essential:    aws.Bool(essential),
+		DependsOn:    dependsOn,
+		LogConfiguration: &ecs.LogConfiguration{
+			LogDriver: aws.String(ecs.LogDriverAwslogs),
+			Options: map[string]*string{
+				"awslogs-group":         aws.String(config.CloudWatchLogGroup),
+				"awslogs-region":        aws.String(config.Region),
+				"awslogs-stream-prefix": aws.String("ecs"),
+			},
+		},
+	}
+
+	// ECS requires a nil HealthCheck when a container has none configured;
+	// an empty-but-non-nil struct is rejected by RegisterTaskDefinition.
+	if probe := container.ReadinessProbe; probe != nil {
+		healthCheck, err := probeToHealthCheck(probe)
+		if err != nil {
+			return nil, fmt.Errorf("unable to translate readiness probe: %v", err)
+		}
+		def.HealthCheck = healthCheck
+	} else if probe := container.LivenessProbe; probe != nil {
+		healthCheck, err := probeToHealthCheck(probe)
+		if err != nil {
+			return nil, fmt.Errorf("unable to translate liveness probe: %v", err)
+		}
+		def.HealthCheck = healthCheck
+	}
+
+	return def, nil
+}
+
+// probeToHealthCheck translates a v1.Probe into the equivalent ECS
+// container healthCheck, run in-container via exec since ECS has no notion
+// of a separate HTTP/TCP health checker.
+func probeToHealthCheck(probe *v1.Probe) (*ecs.HealthCheck, error) {
+	var cmd string
+	switch {
+	case probe.Exec != nil:
+		cmd = shellJoin(probe.Exec.Command)
+	case probe.HTTPGet != nil:
+		cmd = httpGetToShellCommand(probe.HTTPGet)
+	case probe.TCPSocket != nil:
+		host := probe.TCPSocket.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		cmd = fmt.Sprintf("nc -z %s %s", host, probe.TCPSocket.Port.String())
+	default:
+		return nil, fmt.Errorf("probe has no Exec, HTTPGet or TCPSocket action set")
+	}
+
+	interval := int64(probe.PeriodSeconds)
+	if interval == 0 {
+		interval = 30
+	}
+	timeout := int64(probe.TimeoutSeconds)
+	if timeout == 0 {
+		timeout = 5
+	}
+	retries := int64(probe.FailureThreshold)
+	if retries == 0 {
+		retries = 3
+	}
+
+	healthCheck := &ecs.HealthCheck{
+		Command:  aws.StringSlice([]string{"CMD-SHELL", cmd}),
+		Interval: aws.Int64(interval),
+		Timeout:  aws.Int64(timeout),
+		Retries:  aws.Int64(retries),
+	}
+	if probe.InitialDelaySeconds > 0 {
+		healthCheck.StartPeriod = aws.Int64(int64(probe.InitialDelaySeconds))
+	}
+
+	return healthCheck, nil
+}
+
+// wrapEntrypointWithPostStart builds the `sh -c` command that runs the
+// container's PostStart hook, touches postStartSentinel, and then execs the
+// container's original entrypoint and args.
+//
+// This only works for containers that specify an explicit Command; a
+// container relying on its image's built-in ENTRYPOINT has nothing for us
+// to exec here, since the virtual kubelet cannot inspect the image.
+func wrapEntrypointWithPostStart(container v1.Container) (string, error) {
+	if len(container.Command) == 0 {
+		return "", fmt.Errorf("container %q has no Command; PostStart hooks require an explicit entrypoint", container.Name)
+	}
+
+	hookCmd, err := lifecycleHandlerToShellCommand(container.Lifecycle.PostStart)
+	if err != nil {
+		return "", err
+	}
+
+	original := shellJoin(append(append([]string{}, container.Command...), container.Args...))
+
+	return fmt.Sprintf("%s; touch %s; exec %s", hookCmd, postStartSentinel, original), nil
+}
+
+// lifecycleHandlerToShellCommand translates a v1.Handler into a shell
+// command, so that HTTP-style hooks run as an in-container wget exec just
+// like they would if a real kubelet were driving the container.
+func lifecycleHandlerToShellCommand(handler *v1.Handler) (string, error) {
+	switch {
+	case handler.Exec != nil:
+		return shellJoin(handler.Exec.Command), nil
+	case handler.HTTPGet != nil:
+		return httpGetToShellCommand(handler.HTTPGet), nil
+	case handler.TCPSocket != nil:
+		host := handler.TCPSocket.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		return fmt.Sprintf("nc -z %s %s", host, handler.TCPSocket.Port.String()), nil
+	default:
+		return "", fmt.Errorf("lifecycle handler has no Exec, HTTPGet or TCPSocket action set")
+	}
+}
+
+func httpGetToShellCommand(action *v1.HTTPGetAction) string {
+	host := action.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	scheme := strings.ToLower(string(action.Scheme))
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	url := fmt.Sprintf("%s://%s:%s%s", scheme, host, action.Port.String(), action.Path)
+
+	args := []string{"wget", "-q", "-O-"}
+	for _, header := range action.HTTPHeaders {
+		args = append(args, "--header="+fmt.Sprintf("%s: %s", header.Name, header.Value))
+	}
+	args = append(args, url)
+
+	return shellJoin(args)
+}
+
+// shellJoin quotes each argument for /bin/sh and joins them with spaces.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// taskCPU sums the app containers' CPU requests; since init containers run
+// to completion before any app container starts, the task only ever needs
+// as much CPU as the larger of "all init containers individually" or "all
+// app containers at once", so the result is the larger of the app
+// containers' summed request and the single largest init container's.
+func taskCPU(pod *v1.Pod) string {
+	var total int64
+	for _, container := range pod.Spec.Containers {
+		total += container.Resources.Requests.Cpu().MilliValue() / 1000
+	}
+	for _, container := range pod.Spec.InitContainers {
+		if cpu := container.Resources.Requests.Cpu().MilliValue() / 1000; cpu > total {
+			total = cpu
+		}
+	}
+	return fmt.Sprintf("%d", total)
+}
+
+func taskMemory(pod *v1.Pod) string {
+	var total int64
+	for _, container := range pod.Spec.Containers {
+		total += container.Resources.Limits.Memory().Value() / (1024 * 1024)
+	}
+	for _, container := range pod.Spec.InitContainers {
+		if mem := container.Resources.Limits.Memory().Value() / (1024 * 1024); mem > total {
+			total = mem
+		}
+	}
+	return fmt.Sprintf("%d", total)
+}
+
+// taskToPod translates an ECS task back into a v1.Pod shell, using the tags
+// set by CreatePod to recover the pod's namespace, name and UID.
+func (p *Provider) taskToPod(task *ecs.Task) (*v1.Pod, error) {
+	namespace, name, uid := podIdentityFromTags(task.Tags)
+	if name == "" {
+		return nil, fmt.Errorf("task %s has no PodName tag", aws.StringValue(task.TaskArn))
+	}
+
+	status, err := p.taskToPodStatus(task)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			UID:       types.UID(uid),
+		},
+		Status: *status,
+	}, nil
+}
+
+// taskToPodStatus translates an ECS task's status into a v1.PodStatus: it
+// aggregates each ECS container's health into ContainerStatuses[i].Ready,
+// fails the pod when an essential (non-sidecar) container exited non-zero or
+// never got to run at all (e.g. an init container's dependsOn condition was
+// never satisfied, so ECS stopped the task before its dependents started),
+// and surfaces a DisruptionTarget condition when ECS stopped the task
+// out-of-band rather than in response to DeletePod.
+func (p *Provider) taskToPodStatus(task *ecs.Task) (*v1.PodStatus, error) {
+	essential, err := p.essentialContainerNames(task)
+	if err != nil {
+		return nil, err
+	}
+
+	taskStopped := aws.StringValue(task.LastStatus) == ecs.DesiredStatusStopped
+
+	status := &v1.PodStatus{}
+	essentialFailed := false
+
+	for _, container := range task.Containers {
+		name := aws.StringValue(container.Name)
+		running := aws.StringValue(container.LastStatus) == "RUNNING"
+		healthy := container.HealthStatus == nil || aws.StringValue(container.HealthStatus) != ecs.HealthStatusUnhealthy
+
+		status.ContainerStatuses = append(status.ContainerStatuses, v1.ContainerStatus{
+			Name:  name,
+			Ready: running && healthy,
+		})
+
+		if !essential[name] {
+			continue
+		}
+		if container.ExitCode != nil && *container.ExitCode != 0 {
+			essentialFailed = true
+		} else if taskStopped && container.ExitCode == nil && !running {
+			// The task stopped without this essential container ever running
+			// (and so never getting an ExitCode) - a failed init container's
+			// dependsOn dependents are left in this state, never non-zero
+			// themselves because they never started.
+			essentialFailed = true
+		}
+	}
+
+	status.Phase = taskStatusToPodPhase(aws.StringValue(task.LastStatus), essentialFailed)
+
+	if condition := disruptionConditionForTask(task); condition != nil {
+		status.Conditions = append(status.Conditions, *condition)
+	}
+
+	return status, nil
+}
+
+// essentialContainerNames looks up which of task's containers were
+// registered as essential, since that information only lives on the task
+// definition, not the running task.
+func (p *Provider) essentialContainerNames(task *ecs.Task) (map[string]bool, error) {
+	output, err := p.ecsClient.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: task.TaskDefinitionArn,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe task definition %s: %v", aws.StringValue(task.TaskDefinitionArn), err)
+	}
+
+	essential := map[string]bool{}
+	for _, def := range output.TaskDefinition.ContainerDefinitions {
+		if aws.BoolValue(def.Essential) {
+			essential[aws.StringValue(def.Name)] = true
+		}
+	}
+	return essential, nil
+}
+
+func taskStatusToPodPhase(lastStatus string, essentialContainerFailed bool) v1.PodPhase {
+	switch lastStatus {
+	case ecs.DesiredStatusRunning:
+		return v1.PodRunning
+	case ecs.DesiredStatusStopped:
+		if essentialContainerFailed {
+			return v1.PodFailed
+		}
+		return v1.PodSucceeded
+	default:
+		return v1.PodPending
+	}
+}
+
+func podIdentityFromTags(tags []*ecs.Tag) (namespace, name, uid string) {
+	for _, tag := range tags {
+		switch aws.StringValue(tag.Key) {
+		case "PodNamespace":
+			namespace = aws.StringValue(tag.Value)
+		case "PodName":
+			name = aws.StringValue(tag.Value)
+		case "PodUID":
+			uid = aws.StringValue(tag.Value)
+		}
+	}
+	return namespace, name, uid
+}
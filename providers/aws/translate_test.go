@@ -0,0 +1,83 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"k8s.io/api/core/v1"
+)
+
+// taskDefinitionClient wraps ecsiface.ECSAPI and answers DescribeTaskDefinition
+// with a canned set of essential/non-essential container names, so tests can
+// exercise taskToPodStatus without real AWS resources.
+type taskDefinitionClient struct {
+	ecsiface.ECSAPI
+	essential map[string]bool
+}
+
+func (c *taskDefinitionClient) DescribeTaskDefinition(input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+	var defs []*ecs.ContainerDefinition
+	for name, essential := range c.essential {
+		defs = append(defs, &ecs.ContainerDefinition{
+			Name:      aws.String(name),
+			Essential: aws.Bool(essential),
+		})
+	}
+	return &ecs.DescribeTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{ContainerDefinitions: defs},
+	}, nil
+}
+
+func TestTaskToPodStatusFailsWhenEssentialContainerNeverRan(t *testing.T) {
+	p := &Provider{
+		ecsClient: &taskDefinitionClient{
+			essential: map[string]bool{"init": false, "app": true},
+		},
+	}
+
+	// The init container failed (dependsOn condition: SUCCESS was never
+	// satisfied), so "app" was never started: it has no ExitCode at all,
+	// even though the overall task has stopped.
+	task := &ecs.Task{
+		LastStatus:        aws.String(ecs.DesiredStatusStopped),
+		TaskDefinitionArn: aws.String("task-def"),
+		Containers: []*ecs.Container{
+			{Name: aws.String("init"), LastStatus: aws.String("STOPPED"), ExitCode: aws.Int64(1)},
+			{Name: aws.String("app"), LastStatus: aws.String("PENDING")},
+		},
+	}
+
+	status, err := p.taskToPodStatus(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Phase != v1.PodFailed {
+		t.Errorf("expected PodFailed when an essential container never ran, got %v", status.Phase)
+	}
+}
+
+func TestTaskToPodStatusSucceedsWhenEssentialContainerExitsZero(t *testing.T) {
+	p := &Provider{
+		ecsClient: &taskDefinitionClient{
+			essential: map[string]bool{"app": true},
+		},
+	}
+
+	task := &ecs.Task{
+		LastStatus:        aws.String(ecs.DesiredStatusStopped),
+		TaskDefinitionArn: aws.String("task-def"),
+		Containers: []*ecs.Container{
+			{Name: aws.String("app"), LastStatus: aws.String("STOPPED"), ExitCode: aws.Int64(0)},
+		},
+	}
+
+	status, err := p.taskToPodStatus(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Phase != v1.PodSucceeded {
+		t.Errorf("expected PodSucceeded, got %v", status.Phase)
+	}
+}
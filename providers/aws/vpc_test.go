@@ -0,0 +1,137 @@
+package aws
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// createVpcWithInternetAccess stands up a throwaway VPC with a single public
+// subnet and an internet gateway, so TestAWS can run tasks that can pull
+// images and reach the public internet. It returns the subnet ID.
+func createVpcWithInternetAccess(client *ec2.EC2) (*string, error) {
+	vpc, err := client.CreateVpc(&ec2.CreateVpcInput{
+		CidrBlock: aws.String("10.90.0.0/16"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create e2e test VPC: %v", err)
+	}
+	vpcID := vpc.Vpc.VpcId
+
+	subnet, err := client.CreateSubnet(&ec2.CreateSubnetInput{
+		VpcId:     vpcID,
+		CidrBlock: aws.String("10.90.0.0/24"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create e2e test subnet: %v", err)
+	}
+	subnetID := subnet.Subnet.SubnetId
+
+	_, err = client.ModifySubnetAttribute(&ec2.ModifySubnetAttributeInput{
+		SubnetId:            subnetID,
+		MapPublicIpOnLaunch: &ec2.AttributeBooleanValue{Value: aws.Bool(true)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to enable auto-assign public IP on e2e test subnet: %v", err)
+	}
+
+	gateway, err := client.CreateInternetGateway(&ec2.CreateInternetGatewayInput{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create e2e test internet gateway: %v", err)
+	}
+	gatewayID := gateway.InternetGateway.InternetGatewayId
+
+	if _, err := client.AttachInternetGateway(&ec2.AttachInternetGatewayInput{
+		VpcId:             vpcID,
+		InternetGatewayId: gatewayID,
+	}); err != nil {
+		return nil, fmt.Errorf("unable to attach e2e test internet gateway: %v", err)
+	}
+
+	routeTables, err := client.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: []*string{vpcID}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe e2e test route tables: %v", err)
+	}
+	if len(routeTables.RouteTables) == 0 {
+		return nil, fmt.Errorf("e2e test VPC has no main route table")
+	}
+	routeTableID := routeTables.RouteTables[0].RouteTableId
+
+	if _, err := client.CreateRoute(&ec2.CreateRouteInput{
+		RouteTableId:         routeTableID,
+		DestinationCidrBlock: aws.String("0.0.0.0/0"),
+		GatewayId:            gatewayID,
+	}); err != nil {
+		return nil, fmt.Errorf("unable to create e2e test default route: %v", err)
+	}
+
+	// Give the VPC a moment to settle before tasks attempt to attach to it.
+	time.Sleep(5 * time.Second)
+
+	return subnetID, nil
+}
+
+// deleteVpc tears down the single e2e test VPC created by
+// createVpcWithInternetAccess, along with its subnet and internet gateway.
+func deleteVpc(client *ec2.EC2) error {
+	vpcs, err := client.DescribeVpcs(&ec2.DescribeVpcsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("cidr"), Values: []*string{aws.String("10.90.0.0/16")}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to find e2e test VPC: %v", err)
+	}
+	if len(vpcs.Vpcs) == 0 {
+		return nil
+	}
+	vpcID := vpcs.Vpcs[0].VpcId
+
+	subnets, err := client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: []*string{vpcID}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to describe e2e test subnets: %v", err)
+	}
+	for _, subnet := range subnets.Subnets {
+		if _, err := client.DeleteSubnet(&ec2.DeleteSubnetInput{SubnetId: subnet.SubnetId}); err != nil {
+			return fmt.Errorf("unable to delete e2e test subnet %s: %v", *subnet.SubnetId, err)
+		}
+	}
+
+	gateways, err := client.DescribeInternetGateways(&ec2.DescribeInternetGatewaysInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("attachment.vpc-id"), Values: []*string{vpcID}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to describe e2e test internet gateways: %v", err)
+	}
+	for _, gateway := range gateways.InternetGateways {
+		if _, err := client.DetachInternetGateway(&ec2.DetachInternetGatewayInput{
+			VpcId:             vpcID,
+			InternetGatewayId: gateway.InternetGatewayId,
+		}); err != nil {
+			return fmt.Errorf("unable to detach e2e test internet gateway: %v", err)
+		}
+		if _, err := client.DeleteInternetGateway(&ec2.DeleteInternetGatewayInput{
+			InternetGatewayId: gateway.InternetGatewayId,
+		}); err != nil {
+			return fmt.Errorf("unable to delete e2e test internet gateway: %v", err)
+		}
+	}
+
+	if _, err := client.DeleteVpc(&ec2.DeleteVpcInput{VpcId: vpcID}); err != nil {
+		return fmt.Errorf("unable to delete e2e test VPC: %v", err)
+	}
+
+	return nil
+}